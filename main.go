@@ -1,14 +1,20 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/ssoready/ssoready-go"
 	ssoreadyclient "github.com/ssoready/ssoready-go/client"
 	ssoreadyoption "github.com/ssoready/ssoready-go/option"
+
+	"github.com/ssoready/ssoready-example-app-golang-saml/session"
 )
 
 // This demo just renders plain old HTML with no client-side JavaScript. This is
@@ -55,6 +61,61 @@ var indexTemplate = template.Must(template.New("").Parse(`
 </html>
 `))
 
+// relayState is the shape of the data we round-trip through SAML's
+// RelayState parameter. IDPs treat RelayState as an opaque string, so we're
+// free to stuff whatever we want in here -- we base64-encode a small JSON
+// payload so we can recover it in /ssoready-callback.
+type relayState struct {
+	RedirectTo string `json:"redirect_to"`
+	Action     string `json:"action"`
+}
+
+func encodeRelayState(s relayState) string {
+	data, err := json.Marshal(s)
+	if err != nil {
+		panic(err)
+	}
+	return base64.URLEncoding.EncodeToString(data)
+}
+
+func decodeRelayState(s string) relayState {
+	var state relayState
+	data, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		// RelayState is attacker-controlled and optional; fall back to the
+		// zero value rather than failing the login.
+		return state
+	}
+	_ = json.Unmarshal(data, &state)
+	return state
+}
+
+// derefOrEmpty returns *s, or "" if s is nil. The SSOReady SDK returns
+// several response fields as *string, since they're absent for some
+// configurations.
+func derefOrEmpty(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// sameOriginRedirectTo validates redirectTo before it's used to send a
+// just-logged-in user somewhere. redirectTo comes from RelayState, which is
+// attacker-controlled: anyone can start a login at /saml-redirect?redirect_to=
+// with whatever value they like. Without this check, a crafted redirect_to
+// would let an attacker bounce a victim who just authenticated for real
+// straight to an external phishing page.
+//
+// Only same-origin, absolute paths are allowed; everything else (empty,
+// scheme-relative like "//evil.example", or absolute URLs) falls back to "/".
+func sameOriginRedirectTo(redirectTo string) string {
+	if strings.HasPrefix(redirectTo, "/") && !strings.HasPrefix(redirectTo, "//") {
+		return redirectTo
+	}
+	return "/"
+}
+
 func main() {
 	mux := http.NewServeMux()
 
@@ -70,11 +131,29 @@ func main() {
 	// hard-code and publicly leak this API key.
 	ssoreadyClient := ssoreadyclient.NewClient(ssoreadyoption.WithAPIKey("ssoready_sk_4w96zfjul38drbitw1hbd3sqv"))
 
+	// Sessions are signed with HMAC-SHA256 using a key loaded from
+	// SESSION_SECRET, so that a session cookie can't be forged or tampered
+	// with client-side.
+	//
+	// SESSION_SECRET can hold more than one comma-separated key. The first
+	// key signs new sessions; every key is accepted when verifying one, so
+	// you can rotate SESSION_SECRET (prepend a new key, drop the oldest once
+	// it's no longer in use) without logging everyone out at once.
+	//
+	// This is hard-coded here for the same reason the SSOReady API key above
+	// is: it's only acceptable because this demo is hard-coded to run on
+	// http://localhost:8080. In production, set a real SESSION_SECRET
+	// environment variable instead.
+	sessionSecret := os.Getenv("SESSION_SECRET")
+	if sessionSecret == "" {
+		sessionSecret = "dev-only-insecure-session-secret"
+	}
+	sessions := session.NewStore("session", 7*24*time.Hour, session.KeysFromEnv(sessionSecret)...)
+
 	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
 		var email string
-		cookie, _ := r.Cookie("email")
-		if cookie != nil {
-			email = cookie.Value
+		if u, ok := session.FromContext(r.Context()); ok {
+			email = u.Email
 		}
 
 		if err := indexTemplate.Execute(w, map[string]string{"Email": email}); err != nil {
@@ -83,14 +162,11 @@ func main() {
 	})
 
 	// This is the page users visit when they click on the "Log out" link in this
-	// demo app. It just resets the `email` cookie.
+	// demo app. It just clears the session cookie.
 	//
 	// SSOReady doesn't impose any constraints on how your app's sessions work.
 	mux.HandleFunc("GET /logout", func(w http.ResponseWriter, r *http.Request) {
-		http.SetCookie(w, &http.Cookie{
-			Name:   "email",
-			MaxAge: -1,
-		})
+		sessions.ClearCookie(w)
 		http.Redirect(w, r, "/", http.StatusFound)
 	})
 
@@ -100,6 +176,15 @@ func main() {
 		// converts "john.doe@example.com" into "example.com".
 		_, domain, _ := strings.Cut(r.URL.Query().Get("email"), "@")
 
+		// Users often click "Log in with SAML" from a deep link they've
+		// bookmarked (e.g. /settings/billing), rather than this demo's
+		// homepage. We stash where they wanted to go in RelayState, so
+		// /ssoready-callback can send them there once they're logged in.
+		state := encodeRelayState(relayState{
+			RedirectTo: r.URL.Query().Get("redirect_to"),
+			Action:     "login",
+		})
+
 		// To start a SAML login, you need to redirect your user to their employer's
 		// particular Identity Provider. This is called "initiating" the SAML login.
 		//
@@ -110,6 +195,10 @@ func main() {
 			//
 			// In this demo, we identify companies using their domain.
 			OrganizationExternalID: &domain,
+
+			// State is returned back to /ssoready-callback as RelayState once
+			// the user finishes logging in at their IDP.
+			State: &state,
 		})
 		if err != nil {
 			panic(err)
@@ -141,19 +230,31 @@ func main() {
 			panic(err)
 		}
 
+		// converts "john.doe@example.com" into "example.com".
+		_, domain, _ := strings.Cut(*redeemRes.Email, "@")
+
 		// SSOReady works with any stack or session technology you already use.
 		//
-		// As a proof-of-concept, this demo just writes the email as a
-		// plaintext, unsigned cookie. Don't do this in production.
-		http.SetCookie(w, &http.Cookie{
-			Name:  "email",
-			Value: *redeemRes.Email,
-		})
-		http.Redirect(w, r, "/", http.StatusFound)
+		// This demo signs the user into a session cookie using the session
+		// package, rather than the plaintext cookie earlier versions of this
+		// demo used. The SSOReady SDK only hands back the user's email, so
+		// their email domain is all we have to identify the organization by.
+		if err := sessions.SetCookie(w, session.User{
+			Email: *redeemRes.Email,
+			OrgID: domain,
+		}); err != nil {
+			panic(err)
+		}
+
+		// `RedeemSAMLAccessCode` also hands back whatever RelayState we set
+		// in /saml-redirect, so we can send the user back to the deep link
+		// they originally requested instead of always to "/".
+		state := decodeRelayState(derefOrEmpty(redeemRes.State))
+		http.Redirect(w, r, sameOriginRedirectTo(state.RedirectTo), http.StatusFound)
 	})
 
 	fmt.Println("listening on http://localhost:8080")
-	if err := http.ListenAndServe("localhost:8080", mux); err != nil {
+	if err := http.ListenAndServe("localhost:8080", sessions.Middleware(mux)); err != nil {
 		panic(err)
 	}
 }